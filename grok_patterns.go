@@ -0,0 +1,81 @@
+// Copyright 2020 Volodymyr Polishchuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// grokPatternFile is the schema of --nginx.log-pattern-file: a "patterns"
+// map of named grok patterns, of which "default" is used to parse log
+// lines, and an optional "types" map of capture-group-name to "float"/"int"
+// overrides, same as --nginx.log-pattern-types.
+type grokPatternFile struct {
+	Patterns map[string]string `yaml:"patterns"`
+	Types    map[string]string `yaml:"types"`
+}
+
+// loadGrokPatterns resolves the pattern(s) available to the Grok parser and
+// the field-name-to-type mapping used to pick which named capture groups
+// are metrics rather than labels.
+func loadGrokPatterns(logPattern, logPatternTypes, logPatternFile string) ([]string, map[string]string, error) {
+	if logPatternFile == "" {
+		if logPattern == "" {
+			return nil, nil, nil
+		}
+		types, err := parseGrokFieldTypes(logPatternTypes)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []string{logPattern}, types, nil
+	}
+
+	raw, err := os.ReadFile(logPatternFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading nginx.log-pattern-file: %w", err)
+	}
+
+	var file grokPatternFile
+	if err := yaml.Unmarshal(raw, &file); err != nil {
+		return nil, nil, fmt.Errorf("parsing nginx.log-pattern-file: %w", err)
+	}
+
+	pattern, ok := file.Patterns["default"]
+	if !ok {
+		return nil, nil, fmt.Errorf("nginx.log-pattern-file %s has no \"default\" pattern", logPatternFile)
+	}
+	return []string{pattern}, file.Types, nil
+}
+
+// parseGrokFieldTypes parses the comma-separated name:type list accepted by
+// --nginx.log-pattern-types, e.g. "status:int,request_time:float".
+func parseGrokFieldTypes(raw string) (map[string]string, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	types := make(map[string]string)
+	for _, pair := range strings.Split(raw, ",") {
+		name, kind, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed nginx.log-pattern-types entry %q, want name:type", pair)
+		}
+		types[name] = kind
+	}
+	return types, nil
+}
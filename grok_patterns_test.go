@@ -0,0 +1,72 @@
+// Copyright 2020 Volodymyr Polishchuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadGrokPatternsFromFlag(t *testing.T) {
+	patterns, types, err := loadGrokPatterns(`(?P<status>\d+)`, "status:int,host:label", "")
+	if err != nil {
+		t.Fatalf("loadGrokPatterns: %v", err)
+	}
+	if len(patterns) != 1 || patterns[0] != `(?P<status>\d+)` {
+		t.Errorf("patterns = %v", patterns)
+	}
+	if types["status"] != "int" || types["host"] != "label" {
+		t.Errorf("types = %v", types)
+	}
+}
+
+func TestLoadGrokPatternsMalformedTypes(t *testing.T) {
+	if _, _, err := loadGrokPatterns(`(?P<status>\d+)`, "bogus", ""); err == nil {
+		t.Error("loadGrokPatterns with malformed types: expected an error")
+	}
+}
+
+func TestLoadGrokPatternsFromFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "patterns.yaml")
+	content := "patterns:\n  default: \"(?P<status>\\\\d+)\"\ntypes:\n  status: int\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("writing fixture: %v", err)
+	}
+
+	patterns, types, err := loadGrokPatterns("", "", path)
+	if err != nil {
+		t.Fatalf("loadGrokPatterns: %v", err)
+	}
+	if len(patterns) != 1 || patterns[0] != `(?P<status>\d+)` {
+		t.Errorf("patterns = %v", patterns)
+	}
+	if types["status"] != "int" {
+		t.Errorf("types = %v", types)
+	}
+}
+
+func TestLoadGrokPatternsFileMissingDefault(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "patterns.yaml")
+	if err := os.WriteFile(path, []byte("patterns:\n  other: \"foo\"\n"), 0o600); err != nil {
+		t.Fatalf("writing fixture: %v", err)
+	}
+
+	if _, _, err := loadGrokPatterns("", "", path); err == nil {
+		t.Error("loadGrokPatterns with no \"default\" pattern: expected an error")
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 Volodymyr Polishchuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logger builds the exporter's log/slog.Logger from the
+// --log.level/--log.format flags and threads it through a
+// context.Context, replacing the deprecated prometheus/common/log.
+package logger
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+type contextKey struct{}
+
+// New builds a slog.Logger writing logfmt or JSON lines to stderr at the
+// given level. format is "logfmt" (default) or "json"; level is one of
+// debug, info (default), warn or error.
+func New(level, format string) (*slog.Logger, error) {
+	slogLevel, err := parseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: slogLevel}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", "logfmt":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return nil, fmt.Errorf("unknown log.format %q (want logfmt or json)", format)
+	}
+	return slog.New(handler), nil
+}
+
+func parseLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("unknown log.level %q (want debug, info, warn or error)", level)
+	}
+}
+
+// Fatal logs msg at error level and terminates the process, mirroring the
+// log.Fatal behaviour this package replaces.
+func Fatal(log *slog.Logger, msg string, args ...any) {
+	log.Error(msg, args...)
+	os.Exit(1)
+}
+
+// WithContext attaches log to ctx so code that only has a context can
+// still log with the caller's request-scoped fields (see FromContext).
+func WithContext(ctx context.Context, log *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, log)
+}
+
+// FromContext returns the logger attached to ctx by WithContext, or
+// slog.Default() if none was attached.
+func FromContext(ctx context.Context) *slog.Logger {
+	if log, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+		return log
+	}
+	return slog.Default()
+}
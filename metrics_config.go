@@ -0,0 +1,123 @@
+// Copyright 2020 Volodymyr Polishchuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+// MetricConfig declares how a single metric should be collected: which
+// Prometheus collector type backs it, its bucket scheme (histograms
+// only) and which of its labels are allowed to reach Prometheus.
+type MetricConfig struct {
+	// Type is one of "histogram" (default), "native_histogram", "summary"
+	// or "counter".
+	Type string `yaml:"type"`
+	// Buckets overrides the global --histogram.buckets for this metric.
+	// Ignored for native_histogram metrics.
+	Buckets *BucketsConfig `yaml:"buckets,omitempty"`
+	// NativeHistogramBucketFactor and NativeHistogramMaxBucketNumber
+	// configure a type: native_histogram metric; see
+	// prometheus.HistogramOpts for their meaning. BucketFactor defaults
+	// to 1.1 if unset.
+	NativeHistogramBucketFactor    float64 `yaml:"native_histogram_bucket_factor,omitempty"`
+	NativeHistogramMaxBucketNumber uint32  `yaml:"native_histogram_max_bucket_number,omitempty"`
+	// Labels is an allowlist of label names this metric may carry; any
+	// other label parsed out of the log line is dropped. Empty means all
+	// labels are allowed.
+	Labels []string `yaml:"labels,omitempty"`
+}
+
+// BucketsConfig picks one of three ways to describe a histogram's
+// buckets: an explicit slice, or the start/width/count and
+// start/factor/count parameters of prometheus.LinearBuckets and
+// prometheus.ExponentialBuckets respectively.
+type BucketsConfig struct {
+	Explicit    []float64           `yaml:"explicit,omitempty"`
+	Linear      *LinearBuckets      `yaml:"linear,omitempty"`
+	Exponential *ExponentialBuckets `yaml:"exponential,omitempty"`
+}
+
+// LinearBuckets mirrors the parameters of prometheus.LinearBuckets.
+type LinearBuckets struct {
+	Start float64 `yaml:"start"`
+	Width float64 `yaml:"width"`
+	Count int     `yaml:"count"`
+}
+
+// ExponentialBuckets mirrors the parameters of
+// prometheus.ExponentialBuckets.
+type ExponentialBuckets struct {
+	Start  float64 `yaml:"start"`
+	Factor float64 `yaml:"factor"`
+	Count  int     `yaml:"count"`
+}
+
+// resolve turns a BucketsConfig into the bucket boundaries
+// prometheus.HistogramOpts.Buckets expects, validating the parameters
+// instead of relying on prometheus.LinearBuckets/ExponentialBuckets
+// panicking on bad input.
+func (b *BucketsConfig) resolve() ([]float64, error) {
+	switch {
+	case b.Linear != nil:
+		if b.Linear.Count < 1 {
+			return nil, fmt.Errorf("linear buckets: count must be >= 1")
+		}
+		return prometheus.LinearBuckets(b.Linear.Start, b.Linear.Width, b.Linear.Count), nil
+	case b.Exponential != nil:
+		if b.Exponential.Count < 1 {
+			return nil, fmt.Errorf("exponential buckets: count must be >= 1")
+		}
+		if b.Exponential.Start <= 0 {
+			return nil, fmt.Errorf("exponential buckets: start must be > 0")
+		}
+		if b.Exponential.Factor <= 1 {
+			return nil, fmt.Errorf("exponential buckets: factor must be > 1")
+		}
+		return prometheus.ExponentialBuckets(b.Exponential.Start, b.Exponential.Factor, b.Exponential.Count), nil
+	default:
+		return b.Explicit, nil
+	}
+}
+
+// MetricsConfig is the root of the --metrics.config YAML file, keyed by
+// metric name.
+type MetricsConfig struct {
+	Metrics map[string]MetricConfig `yaml:"metrics"`
+}
+
+// loadMetricsConfig reads and parses --metrics.config. An empty path
+// yields a zero-value MetricsConfig, under which every metric defaults to
+// a histogram with no label restrictions.
+func loadMetricsConfig(path string) (MetricsConfig, error) {
+	if path == "" {
+		return MetricsConfig{}, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return MetricsConfig{}, fmt.Errorf("reading metrics.config: %w", err)
+	}
+
+	var config MetricsConfig
+	if err := yaml.Unmarshal(raw, &config); err != nil {
+		return MetricsConfig{}, fmt.Errorf("parsing metrics.config: %w", err)
+	}
+	return config, nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 Volodymyr Polishchuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+func TestBucketsConfigResolveExplicit(t *testing.T) {
+	b := &BucketsConfig{Explicit: []float64{1, 2, 3}}
+	got, err := b.resolve()
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if len(got) != 3 {
+		t.Errorf("got %v, want 3 buckets", got)
+	}
+}
+
+func TestBucketsConfigResolveLinear(t *testing.T) {
+	b := &BucketsConfig{Linear: &LinearBuckets{Start: 1, Width: 2, Count: 3}}
+	got, err := b.resolve()
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	want := []float64{1, 3, 5}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestBucketsConfigResolveLinearInvalidCount(t *testing.T) {
+	b := &BucketsConfig{Linear: &LinearBuckets{Count: 0}}
+	if _, err := b.resolve(); err == nil {
+		t.Error("resolve with count 0: expected an error")
+	}
+}
+
+func TestBucketsConfigResolveExponential(t *testing.T) {
+	b := &BucketsConfig{Exponential: &ExponentialBuckets{Start: 1, Factor: 2, Count: 3}}
+	got, err := b.resolve()
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	want := []float64{1, 2, 4}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestBucketsConfigResolveExponentialInvalid(t *testing.T) {
+	cases := []*BucketsConfig{
+		{Exponential: &ExponentialBuckets{Start: 1, Factor: 2, Count: 0}},
+		{Exponential: &ExponentialBuckets{Start: 0, Factor: 2, Count: 3}},
+		{Exponential: &ExponentialBuckets{Start: 1, Factor: 1, Count: 3}},
+	}
+	for i, b := range cases {
+		if _, err := b.resolve(); err == nil {
+			t.Errorf("case %d: expected an error", i)
+		}
+	}
+}
+
+func TestLoadMetricsConfigEmptyPath(t *testing.T) {
+	config, err := loadMetricsConfig("")
+	if err != nil {
+		t.Fatalf("loadMetricsConfig: %v", err)
+	}
+	if len(config.Metrics) != 0 {
+		t.Errorf("config.Metrics = %v, want empty", config.Metrics)
+	}
+}
+
+func TestLoadMetricsConfigMissingFile(t *testing.T) {
+	if _, err := loadMetricsConfig("/nonexistent/metrics.yaml"); err == nil {
+		t.Error("loadMetricsConfig with missing file: expected an error")
+	}
+}
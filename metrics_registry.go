@@ -0,0 +1,288 @@
+// Copyright 2020 Volodymyr Polishchuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricRegistry lazily creates exactly one Vec collector per (metric
+// name, label-name set) and bounds how many distinct label-value tuples
+// each one may accumulate, evicting the least recently used tuple once a
+// metric's limit is hit. This replaces registering a fresh HistogramVec
+// per log line, which offered no protection against label cardinality
+// explosions.
+type metricRegistry struct {
+	mu       sync.RWMutex
+	families map[string]*metricFamily
+
+	config         MetricsConfig
+	defaultBuckets []float64
+
+	maxSeries      int
+	seriesCount    int
+	maxLabelValues int
+
+	seriesDropped prometheus.Counter
+}
+
+// metricFamily is one registered Vec collector plus an LRU of the
+// label-value tuples currently observed on it.
+type metricFamily struct {
+	name       string
+	collector  prometheus.Collector
+	labelNames []string
+
+	lru      *list.List
+	elements map[string]*list.Element
+}
+
+func newMetricRegistry(config MetricsConfig, defaultBuckets []float64, maxSeries, maxLabelValues int, seriesDropped prometheus.Counter) *metricRegistry {
+	return &metricRegistry{
+		families:       make(map[string]*metricFamily),
+		config:         config,
+		defaultBuckets: defaultBuckets,
+		maxSeries:      maxSeries,
+		maxLabelValues: maxLabelValues,
+		seriesDropped:  seriesDropped,
+	}
+}
+
+// Observe records a single metric value under the given labels, creating
+// the backing collector on first use. Labels not present in the metric's
+// configured allowlist are dropped before the series key is computed. If
+// the registry-wide series cap is full, a sample for a new series is
+// dropped and seriesDropped is incremented; if only the metric's own
+// per-metric cap is full, its least recently used tuple is evicted to make
+// room.
+//
+// names/values are sorted by name before anything else happens, so that
+// two calls carrying the same label set in a different order (as
+// JSONParser produces, since it ranges over a Go map) hit the same
+// collector *and* pair each value with the right name in
+// WithLabelValues, instead of only matching on familyKey's own
+// independently-sorted copy.
+func (r *metricRegistry) Observe(metric Metric, labels Labels) error {
+	names, values := filterLabels(r.config.Metrics[metric.Name], labels)
+	sortLabelsByName(names, values)
+
+	family, err := r.familyFor(metric.Name, names)
+	if err != nil {
+		return err
+	}
+	return family.observe(r, values, metric.Value)
+}
+
+// sortLabelsByName sorts names and values in lockstep by name, so label
+// name/value pairing survives regardless of the order they arrived in.
+func sortLabelsByName(names, values []string) {
+	sort.Sort(&labelSorter{names: names, values: values})
+}
+
+type labelSorter struct {
+	names  []string
+	values []string
+}
+
+func (s *labelSorter) Len() int           { return len(s.names) }
+func (s *labelSorter) Less(i, j int) bool { return s.names[i] < s.names[j] }
+func (s *labelSorter) Swap(i, j int) {
+	s.names[i], s.names[j] = s.names[j], s.names[i]
+	s.values[i], s.values[j] = s.values[j], s.values[i]
+}
+
+func filterLabels(config MetricConfig, labels Labels) ([]string, []string) {
+	if len(config.Labels) == 0 {
+		return labels.Names, labels.Values
+	}
+	allowed := make(map[string]bool, len(config.Labels))
+	for _, name := range config.Labels {
+		allowed[name] = true
+	}
+
+	var names, values []string
+	for i, name := range labels.Names {
+		if allowed[name] {
+			names = append(names, name)
+			values = append(values, labels.Values[i])
+		}
+	}
+	return names, values
+}
+
+// familyFor returns the metricFamily for name+labelNames, creating it
+// (and registering its collector with Prometheus) on first use.
+func (r *metricRegistry) familyFor(name string, labelNames []string) (*metricFamily, error) {
+	key := familyKey(name, labelNames)
+
+	r.mu.RLock()
+	family, ok := r.families[key]
+	r.mu.RUnlock()
+	if ok {
+		return family, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if family, ok := r.families[key]; ok {
+		return family, nil
+	}
+
+	config := r.config.Metrics[name]
+	collector, err := r.newCollector(name, config, labelNames)
+	if err != nil {
+		return nil, err
+	}
+	if err := prometheus.Register(collector); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			collector = are.ExistingCollector
+		} else {
+			return nil, err
+		}
+	}
+
+	family = &metricFamily{
+		name:       name,
+		collector:  collector,
+		labelNames: labelNames,
+		lru:        list.New(),
+		elements:   make(map[string]*list.Element),
+	}
+	r.families[key] = family
+	return family, nil
+}
+
+func familyKey(name string, labelNames []string) string {
+	sorted := append([]string(nil), labelNames...)
+	sort.Strings(sorted)
+	return name + "|" + strings.Join(sorted, ",")
+}
+
+func (r *metricRegistry) newCollector(name string, config MetricConfig, labelNames []string) (prometheus.Collector, error) {
+	help := fmt.Sprintf("Nginx request log value for %s", name)
+
+	switch strings.ToLower(config.Type) {
+	case "", "histogram":
+		buckets := r.defaultBuckets
+		if config.Buckets != nil {
+			resolved, err := config.Buckets.resolve()
+			if err != nil {
+				return nil, fmt.Errorf("metric %s: %w", name, err)
+			}
+			buckets = resolved
+		}
+		return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      name,
+			Help:      help,
+			Buckets:   buckets,
+		}, labelNames), nil
+	case "native_histogram":
+		bucketFactor := config.NativeHistogramBucketFactor
+		if bucketFactor == 0 {
+			bucketFactor = 1.1
+		}
+		return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:                      namespace,
+			Name:                           name,
+			Help:                           help,
+			NativeHistogramBucketFactor:    bucketFactor,
+			NativeHistogramMaxBucketNumber: config.NativeHistogramMaxBucketNumber,
+		}, labelNames), nil
+	case "summary":
+		return prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Namespace: namespace,
+			Name:      name,
+			Help:      help,
+		}, labelNames), nil
+	case "counter":
+		return prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      name,
+			Help:      help,
+		}, labelNames), nil
+	default:
+		return nil, fmt.Errorf("metric %s: unknown type %q", name, config.Type)
+	}
+}
+
+// observe records value under values, evicting the least recently used
+// tuple if this metric is at its per-metric cap. The registry-wide series
+// cap is checked first: if it's full the sample is dropped outright
+// instead of recording it, so a new (and immediately discarded) sample
+// never evicts a still-valid series to make room for itself.
+func (f *metricFamily) observe(r *metricRegistry, values []string, value float64) error {
+	tupleKey := strings.Join(values, "\xff")
+
+	r.mu.Lock()
+	if element, ok := f.elements[tupleKey]; ok {
+		f.lru.MoveToFront(element)
+		r.mu.Unlock()
+	} else {
+		if r.maxSeries > 0 && r.seriesCount >= r.maxSeries {
+			r.mu.Unlock()
+			r.seriesDropped.Inc()
+			return nil
+		}
+		if r.maxLabelValues > 0 && f.lru.Len() >= r.maxLabelValues {
+			f.evictOldest(r)
+		}
+		f.elements[tupleKey] = f.lru.PushFront(tupleKey)
+		r.seriesCount++
+		r.mu.Unlock()
+	}
+
+	switch collector := f.collector.(type) {
+	case *prometheus.HistogramVec:
+		collector.WithLabelValues(values...).Observe(value)
+	case *prometheus.SummaryVec:
+		collector.WithLabelValues(values...).Observe(value)
+	case *prometheus.CounterVec:
+		collector.WithLabelValues(values...).Add(value)
+	default:
+		return fmt.Errorf("metric %s: collector type %T cannot be observed", f.name, f.collector)
+	}
+	return nil
+}
+
+// evictOldest drops the least recently used label-value tuple from both
+// the LRU and the underlying Vec. Callers must hold r.mu.
+func (f *metricFamily) evictOldest(r *metricRegistry) {
+	oldest := f.lru.Back()
+	if oldest == nil {
+		return
+	}
+	tupleKey := oldest.Value.(string)
+	values := strings.Split(tupleKey, "\xff")
+
+	switch collector := f.collector.(type) {
+	case *prometheus.HistogramVec:
+		collector.DeleteLabelValues(values...)
+	case *prometheus.SummaryVec:
+		collector.DeleteLabelValues(values...)
+	case *prometheus.CounterVec:
+		collector.DeleteLabelValues(values...)
+	}
+
+	f.lru.Remove(oldest)
+	delete(f.elements, tupleKey)
+	r.seriesCount--
+}
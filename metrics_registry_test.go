@@ -0,0 +1,227 @@
+// Copyright 2020 Volodymyr Polishchuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// collectMetrics drains a Collector's current samples for inspection,
+// decoded to their protobuf representation so individual label/value
+// pairs can be checked.
+func collectMetrics(t *testing.T, c prometheus.Collector) []*dto.Metric {
+	t.Helper()
+	ch := make(chan prometheus.Metric, 10)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+
+	var out []*dto.Metric
+	for m := range ch {
+		pb := &dto.Metric{}
+		if err := m.Write(pb); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		out = append(out, pb)
+	}
+	return out
+}
+
+func newTestRegistry(maxSeries, maxLabelValues int) *metricRegistry {
+	dropped := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_series_dropped_total"})
+	return newMetricRegistry(MetricsConfig{}, []float64{1, 2, 5}, maxSeries, maxLabelValues, dropped)
+}
+
+func TestMetricRegistryObserveCreatesFamily(t *testing.T) {
+	r := newTestRegistry(0, 0)
+
+	if err := r.Observe(Metric{Name: "test_a", Value: 1}, Labels{Names: []string{"host"}, Values: []string{"one"}}); err != nil {
+		t.Fatalf("Observe: %v", err)
+	}
+	if err := r.Observe(Metric{Name: "test_a", Value: 2}, Labels{Names: []string{"host"}, Values: []string{"two"}}); err != nil {
+		t.Fatalf("Observe: %v", err)
+	}
+
+	if r.seriesCount != 2 {
+		t.Errorf("seriesCount = %d, want 2", r.seriesCount)
+	}
+	family := r.families[familyKey("test_a", []string{"host"})]
+	if family == nil {
+		t.Fatal("expected a family for test_a|host")
+	}
+	if family.lru.Len() != 2 {
+		t.Errorf("lru.Len() = %d, want 2", family.lru.Len())
+	}
+}
+
+func TestMetricRegistryObserveSameTupleReused(t *testing.T) {
+	r := newTestRegistry(0, 0)
+	labels := Labels{Names: []string{"host"}, Values: []string{"one"}}
+
+	for i := 0; i < 3; i++ {
+		if err := r.Observe(Metric{Name: "test_b", Value: float64(i)}, labels); err != nil {
+			t.Fatalf("Observe: %v", err)
+		}
+	}
+
+	if r.seriesCount != 1 {
+		t.Errorf("seriesCount = %d, want 1 (same tuple observed repeatedly)", r.seriesCount)
+	}
+}
+
+func TestMetricRegistryEvictsLeastRecentlyUsed(t *testing.T) {
+	r := newTestRegistry(0, 2)
+
+	observe := func(value string) {
+		if err := r.Observe(Metric{Name: "test_c", Value: 1}, Labels{Names: []string{"host"}, Values: []string{value}}); err != nil {
+			t.Fatalf("Observe(%s): %v", value, err)
+		}
+	}
+	observe("one")
+	observe("two")
+	observe("three") // should evict "one", the least recently used
+
+	family := r.families[familyKey("test_c", []string{"host"})]
+	if family.lru.Len() != 2 {
+		t.Fatalf("lru.Len() = %d, want 2", family.lru.Len())
+	}
+	if _, ok := family.elements["one"]; ok {
+		t.Error("\"one\" should have been evicted")
+	}
+	if _, ok := family.elements["two"]; !ok {
+		t.Error("\"two\" should still be present")
+	}
+	if _, ok := family.elements["three"]; !ok {
+		t.Error("\"three\" should still be present")
+	}
+}
+
+func TestMetricRegistryDropsOnSeriesCap(t *testing.T) {
+	dropped := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_d_series_dropped_total"})
+	r := newMetricRegistry(MetricsConfig{}, []float64{1}, 1, 0, dropped)
+
+	if err := r.Observe(Metric{Name: "test_d", Value: 1}, Labels{Names: []string{"host"}, Values: []string{"one"}}); err != nil {
+		t.Fatalf("Observe: %v", err)
+	}
+	if err := r.Observe(Metric{Name: "test_d", Value: 1}, Labels{Names: []string{"host"}, Values: []string{"two"}}); err != nil {
+		t.Fatalf("Observe: %v", err)
+	}
+
+	if r.seriesCount != 1 {
+		t.Errorf("seriesCount = %d, want 1 (registry-wide cap reached)", r.seriesCount)
+	}
+	if got := testutil.ToFloat64(dropped); got != 1 {
+		t.Errorf("seriesDropped = %v, want 1", got)
+	}
+}
+
+// TestMetricRegistryLabelOrderIndependent covers observing the same
+// metric with its label names in a different order across calls, as
+// JSONParser produces since it ranges over a Go map. Both calls must
+// land on the same family and keep each value paired with its own name,
+// not the first call's name order.
+func TestMetricRegistryLabelOrderIndependent(t *testing.T) {
+	r := newTestRegistry(0, 0)
+
+	if err := r.Observe(Metric{Name: "test_f", Value: 1}, Labels{Names: []string{"host", "status"}, Values: []string{"example.com", "200"}}); err != nil {
+		t.Fatalf("Observe: %v", err)
+	}
+	if err := r.Observe(Metric{Name: "test_f", Value: 1}, Labels{Names: []string{"status", "host"}, Values: []string{"503", "other.com"}}); err != nil {
+		t.Fatalf("Observe: %v", err)
+	}
+
+	family := r.families[familyKey("test_f", []string{"host", "status"})]
+	if family == nil {
+		t.Fatal("expected a single family regardless of label order")
+	}
+	collector, ok := family.collector.(*prometheus.HistogramVec)
+	if !ok {
+		t.Fatalf("collector type = %T, want *prometheus.HistogramVec", family.collector)
+	}
+
+	statusByHost := make(map[string]string)
+	for _, m := range collectMetrics(t, collector) {
+		labels := make(map[string]string)
+		for _, lp := range m.GetLabel() {
+			labels[lp.GetName()] = lp.GetValue()
+		}
+		statusByHost[labels["host"]] = labels["status"]
+	}
+
+	if statusByHost["example.com"] != "200" {
+		t.Errorf("status for host=example.com = %q, want 200", statusByHost["example.com"])
+	}
+	if statusByHost["other.com"] != "503" {
+		t.Errorf("status for host=other.com = %q, want 503", statusByHost["other.com"])
+	}
+}
+
+// TestMetricRegistryDoesNotEvictWhenSeriesCapFull covers the case where a
+// metric is at its per-family maxLabelValues cap and the registry-wide
+// maxSeries cap is also full: the new sample must be dropped outright,
+// not admitted at the cost of evicting a still-valid series.
+func TestMetricRegistryDoesNotEvictWhenSeriesCapFull(t *testing.T) {
+	dropped := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_g_series_dropped_total"})
+	r := newMetricRegistry(MetricsConfig{}, []float64{1}, 2, 2, dropped)
+
+	observe := func(value string) {
+		if err := r.Observe(Metric{Name: "test_g", Value: 1}, Labels{Names: []string{"host"}, Values: []string{value}}); err != nil {
+			t.Fatalf("Observe(%s): %v", value, err)
+		}
+	}
+	observe("one")
+	observe("two")
+	observe("three")
+
+	family := r.families[familyKey("test_g", []string{"host"})]
+	if _, ok := family.elements["one"]; !ok {
+		t.Error("\"one\" should not have been evicted: the registry-wide cap was full, so the new sample should have been dropped instead")
+	}
+	if _, ok := family.elements["three"]; ok {
+		t.Error("\"three\" should have been dropped, not admitted")
+	}
+	if got := testutil.ToFloat64(dropped); got != 1 {
+		t.Errorf("seriesDropped = %v, want 1", got)
+	}
+}
+
+func TestMetricRegistryFilterLabels(t *testing.T) {
+	config := MetricConfig{Labels: []string{"host"}}
+	names, values := filterLabels(config, Labels{Names: []string{"host", "status"}, Values: []string{"example.com", "200"}})
+	if len(names) != 1 || names[0] != "host" || values[0] != "example.com" {
+		t.Errorf("filterLabels = %v %v, want only host", names, values)
+	}
+
+	names, values = filterLabels(MetricConfig{}, Labels{Names: []string{"host", "status"}, Values: []string{"example.com", "200"}})
+	if len(names) != 2 {
+		t.Errorf("filterLabels with no allowlist = %v %v, want both labels", names, values)
+	}
+}
+
+func TestMetricRegistryUnknownCollectorType(t *testing.T) {
+	r := newTestRegistry(0, 0)
+	r.config = MetricsConfig{Metrics: map[string]MetricConfig{
+		"test_e": {Type: "bogus"},
+	}}
+
+	if err := r.Observe(Metric{Name: "test_e", Value: 1}, Labels{}); err == nil {
+		t.Error("Observe with unknown collector type: expected an error")
+	}
+}
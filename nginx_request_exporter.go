@@ -15,18 +15,22 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/prometheus/common/log"
-	"gopkg.in/mcuadros/go-syslog.v2"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/volodymyr-polishchuk/nginx-request-exporter/internal/logger"
+	"gopkg.in/mcuadros/go-syslog.v2"
 )
 
 const (
@@ -36,13 +40,38 @@ const (
 
 func main() {
 	parameters := readParameters()
-	floatBuckets := parseMetricBuckets(parameters["metricBuckets"])
-	channel, server, err := setupSyslogServer(parameters["syslogAddress"])
-	syslogMessages, syslogParseFailures := setupSyslogSystemMetrics()
 
-	processMetricsFromSyslog(channel, syslogMessages, syslogParseFailures, floatBuckets)
-	startWebServer(parameters["metricsPath"], parameters["listenAddress"])
-	waitForShutdown(server, err)
+	log, err := logger.New(parameters["logLevel"], parameters["logOutputFormat"])
+	if err != nil {
+		logger.Fatal(slog.Default(), "configuring logger", "error", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = logger.WithContext(ctx, log)
+
+	floatBuckets := parseMetricBuckets(ctx, parameters["metricBuckets"])
+	parser, err := newParser(parameters["logFormat"], parameters["logPattern"], parameters["logPatternTypes"], parameters["logPatternFile"])
+	if err != nil {
+		logger.Fatal(log, "configuring log parser", "error", err)
+	}
+	channel, server, err := setupSyslogServer(ctx,
+		parameters["syslogAddress"],
+		parameters["syslogFormat"],
+		parameters["syslogTLSCertFile"],
+		parameters["syslogTLSKeyFile"],
+		parameters["syslogTLSCAFile"])
+	syslogMessages, syslogParseFailures := setupSyslogSystemMetrics(ctx)
+	registry, err := setupMetricRegistry(parameters["metricsConfig"], parameters["metricsMaxSeries"], parameters["metricsMaxLabelValues"], floatBuckets)
+	if err != nil {
+		logger.Fatal(log, "configuring metric registry", "error", err)
+	}
+
+	ready := &readiness{}
+	processMetricsFromSyslog(ctx, channel, syslogMessages, syslogParseFailures, parser, registry, ready)
+	webServer, err := startWebServer(ctx, parameters["metricsPath"], parameters["listenAddress"], parameters["webConfigFile"], ready)
+	if err != nil {
+		logger.Fatal(log, "starting web server", "error", err)
+	}
+	waitForShutdown(ctx, cancel, server, webServer)
 }
 
 func GetEnv(key, fallback string) string {
@@ -53,66 +82,72 @@ func GetEnv(key, fallback string) string {
 	return value
 }
 
-func processMetricsFromSyslog(channel syslog.LogPartsChannel, syslogMessages prometheus.Counter, syslogParseFailures prometheus.Counter, floatBuckets []float64) {
+func processMetricsFromSyslog(ctx context.Context, channel syslog.LogPartsChannel, syslogMessages prometheus.Counter, syslogParseFailures prometheus.Counter, parser Parser, registry *metricRegistry, ready *readiness) {
+	log := logger.FromContext(ctx)
 	msgs := 0
 	go func() {
-		for part := range channel {
-			syslogMessages.Inc()
-			msgs++
-			tag, _ := part["tag"].(string)
-			if tag != "nginx" {
-				log.Warn("Ignoring syslog message with wrong tag")
-				syslogParseFailures.Inc()
-				continue
-			}
-			server, _ := part["hostname"].(string)
-			if server == "" {
-				log.Warn("Hostname missing in syslog message")
-				syslogParseFailures.Inc()
-				continue
-			}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case part, ok := <-channel:
+				if !ok {
+					return
+				}
+				syslogMessages.Inc()
+				msgs++
+				ready.markReady()
+				tag, _ := part["tag"].(string)
+				hostname, _ := part["hostname"].(string)
+				peer, _ := part["client"].(string)
+				msgLog := log.With("tag", tag, "hostname", hostname, "peer", peer)
 
-			content, _ := part["content"].(string)
-			if content == "" {
-				log.Warn("Ignoring empty syslog message")
-				syslogParseFailures.Inc()
-				continue
-			}
+				if tag != "nginx" {
+					msgLog.Warn("ignoring syslog message with wrong tag")
+					syslogParseFailures.Inc()
+					continue
+				}
+				if hostname == "" {
+					msgLog.Warn("hostname missing in syslog message")
+					syslogParseFailures.Inc()
+					continue
+				}
 
-			metrics, labels, err := parseMessage(content)
-			if err != nil {
-				log.Error(err)
-				continue
-			}
-			for _, metric := range metrics {
-				var collector prometheus.Collector
-				collector = prometheus.NewHistogramVec(prometheus.HistogramOpts{
-					Namespace: namespace,
-					Name:      metric.Name,
-					Help:      fmt.Sprintf("Nginx request log value for %s", metric.Name),
-					Buckets:   floatBuckets,
-				}, labels.Names)
-				if err := prometheus.Register(collector); err != nil {
-					if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
-						collector = are.ExistingCollector.(*prometheus.HistogramVec)
-					} else {
-						log.Error(err)
-						continue
+				content, _ := part["content"].(string)
+				if content == "" {
+					msgLog.Warn("ignoring empty syslog message")
+					syslogParseFailures.Inc()
+					continue
+				}
+
+				metrics, labels, err := parser.Parse(content)
+				if err != nil {
+					msgLog.Error("parsing syslog message", "error", err)
+					continue
+				}
+				if sd, ok := part["structured_data"].(string); ok {
+					sdLabels := parseStructuredData(sd)
+					labels.Names = append(labels.Names, sdLabels.Names...)
+					labels.Values = append(labels.Values, sdLabels.Values...)
+				}
+				for _, metric := range metrics {
+					if err := registry.Observe(metric, labels); err != nil {
+						msgLog.Error("observing metric", "metric", metric.Name, "error", err)
 					}
 				}
-				collector.(*prometheus.HistogramVec).WithLabelValues(labels.Values...).Observe(metric.Value)
 			}
 		}
 	}()
 }
 
 // Parse the buckets
-func parseMetricBuckets(metricBuckets string) []float64 {
+func parseMetricBuckets(ctx context.Context, metricBuckets string) []float64 {
+	log := logger.FromContext(ctx)
 	var floatBuckets []float64
 	for _, str := range strings.Split(metricBuckets, ",") {
 		bucket, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
 		if err != nil {
-			log.Fatal(err)
+			logger.Fatal(log, "parsing histogram.buckets", "error", err)
 		}
 		floatBuckets = append(floatBuckets, bucket)
 	}
@@ -120,7 +155,9 @@ func parseMetricBuckets(metricBuckets string) []float64 {
 }
 
 // Setup metrics
-func setupSyslogSystemMetrics() (prometheus.Counter, prometheus.Counter) {
+func setupSyslogSystemMetrics(ctx context.Context) (prometheus.Counter, prometheus.Counter) {
+	log := logger.FromContext(ctx)
+
 	syslogMessages := prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: namespace,
 		Name:      "exporter_syslog_messages",
@@ -128,8 +165,7 @@ func setupSyslogSystemMetrics() (prometheus.Counter, prometheus.Counter) {
 	})
 
 	if err := prometheus.Register(syslogMessages); err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+		logger.Fatal(log, "registering exporter_syslog_messages", "error", err)
 	}
 
 	syslogParseFailures := prometheus.NewCounter(prometheus.CounterOpts{
@@ -139,40 +175,67 @@ func setupSyslogSystemMetrics() (prometheus.Counter, prometheus.Counter) {
 	})
 
 	if err := prometheus.Register(syslogParseFailures); err != nil {
-		log.Fatal(err)
-		os.Exit(1)
+		logger.Fatal(log, "registering exporter_syslog_parse_failure", "error", err)
 	}
 	return syslogMessages, syslogParseFailures
 }
 
-// Set up syslog server
-func setupSyslogServer(syslogAddress string) (syslog.LogPartsChannel, *syslog.Server, error) {
-	channel := make(syslog.LogPartsChannel, 20000)
-	handler := syslog.NewChannelHandler(channel)
-	server := syslog.NewServer()
-	server.SetFormat(syslog.RFC3164)
-	server.SetHandler(handler)
-
-	var err error
-	if strings.HasPrefix(syslogAddress, "unix:") {
-		err = server.ListenUnixgram(strings.TrimPrefix(syslogAddress, "unix:"))
-	} else {
-		err = server.ListenUDP(syslogAddress)
+// setupMetricRegistry loads --metrics.config (if any) and builds the
+// bounded metricRegistry used to turn parsed Metric/Labels pairs into
+// Prometheus series.
+func setupMetricRegistry(metricsConfigPath, maxSeries, maxLabelValues string, defaultBuckets []float64) (*metricRegistry, error) {
+	config, err := loadMetricsConfig(metricsConfigPath)
+	if err != nil {
+		return nil, err
 	}
+
+	maxSeriesInt, err := strconv.Atoi(maxSeries)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("metrics.max-series: %w", err)
 	}
-	err = server.Boot()
+	maxLabelValuesInt, err := strconv.Atoi(maxLabelValues)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("metrics.max-label-values: %w", err)
+	}
+
+	seriesDropped := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "exporter_series_dropped_total",
+		Help:      "Number of samples dropped because a cardinality bound was exceeded.",
+	})
+	if err := prometheus.Register(seriesDropped); err != nil {
+		return nil, err
 	}
-	return channel, server, err
+
+	return newMetricRegistry(config, defaultBuckets, maxSeriesInt, maxLabelValuesInt, seriesDropped), nil
 }
 
-// Setup HTTP server
-func startWebServer(metricsPath string, listenAddress string) {
-	http.Handle(metricsPath, promhttp.Handler())
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+// startWebServer builds the metrics server's *http.Server, serving
+// metricsPath, "/-/healthy", "/-/ready" and a landing page, optionally
+// behind TLS and/or HTTP basic auth configured via webConfigPath. It
+// starts serving in the background and returns the server so the caller
+// can Shutdown it.
+func startWebServer(ctx context.Context, metricsPath, listenAddress, webConfigPath string, ready *readiness) (*http.Server, error) {
+	log := logger.FromContext(ctx)
+
+	webConfig, err := loadWebConfig(webConfigPath)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, promhttp.Handler())
+	mux.HandleFunc("/-/healthy", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/-/ready", func(w http.ResponseWriter, r *http.Request) {
+		if !ready.isReady() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html><head>
 		<title>` + applicationName + `</title>
 		</head><body>
@@ -181,10 +244,27 @@ func startWebServer(metricsPath string, listenAddress string) {
 		</body></html>`))
 	})
 
+	server := &http.Server{
+		Addr:    listenAddress,
+		Handler: basicAuthMiddleware(webConfig.BasicAuthUsers, mux),
+	}
+
 	go func() {
-		log.Infof("Starting Server: %s", listenAddress)
-		log.Fatal(http.ListenAndServe(listenAddress, nil))
+		log.Info("starting server", "address", listenAddress)
+		var err error
+		if tlsCfg := webConfig.TLSServerConfig; tlsCfg != nil {
+			server.TLSConfig, err = tlsCfg.tlsConfig()
+			if err == nil {
+				err = server.ListenAndServeTLS(tlsCfg.CertFile, tlsCfg.KeyFile)
+			}
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logger.Fatal(log, "running web server", "error", err)
+		}
 	}()
+	return server, nil
 }
 
 func readParameters() map[string]string {
@@ -197,30 +277,97 @@ func readParameters() map[string]string {
 			*flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics."))
 		syslogAddress = GetEnv(
 			"NRE_NGINX_SYSLOG_LISTENER",
-			*flag.String("nginx.syslog-address", "0.0.0.0:9514", "Syslog listen address/socket for Nginx."))
+			*flag.String("nginx.syslog-address", "0.0.0.0:9514", "Syslog listen address/socket for Nginx. Accepts a bare UDP address, or a unix:, tcp://, tcp+tls:// or unixstream:// prefixed address."))
+		syslogFormat = GetEnv(
+			"NRE_NGINX_SYSLOG_FORMAT",
+			*flag.String("nginx.syslog-format", "rfc3164", "Syslog message format sent by Nginx: rfc3164, rfc5424, rfc6587 (octet-counted framing) or auto."))
+		syslogTLSCertFile = GetEnv(
+			"NRE_NGINX_SYSLOG_TLS_CERT_FILE",
+			*flag.String("nginx.syslog-tls-cert-file", "", "Certificate file for tcp+tls:// syslog listeners."))
+		syslogTLSKeyFile = GetEnv(
+			"NRE_NGINX_SYSLOG_TLS_KEY_FILE",
+			*flag.String("nginx.syslog-tls-key-file", "", "Key file for tcp+tls:// syslog listeners."))
+		syslogTLSCAFile = GetEnv(
+			"NRE_NGINX_SYSLOG_TLS_CA_FILE",
+			*flag.String("nginx.syslog-tls-ca-file", "", "Optional CA file to verify client certificates for tcp+tls:// syslog listeners."))
 		metricBuckets = GetEnv(
 			"NRE_HISTOGRAM_BUCKETS",
 			*flag.String("histogram.buckets", ".005,.01,.025,.05,.1,.25,.5,1,2.5,5,10", "Buckets for the Prometheus histogram."))
+		logFormat = GetEnv(
+			"NRE_NGINX_LOG_FORMAT",
+			*flag.String("nginx.log-format", "keyvalue", "Nginx log line format: keyvalue, json or grok."))
+		logPattern = GetEnv(
+			"NRE_NGINX_LOG_PATTERN",
+			*flag.String("nginx.log-pattern", "", "Regexp with named capture groups used to parse log lines when nginx.log-format is grok. Every named group becomes a label unless nginx.log-pattern-types says otherwise."))
+		logPatternTypes = GetEnv(
+			"NRE_NGINX_LOG_PATTERN_TYPES",
+			*flag.String("nginx.log-pattern-types", "", "Comma-separated name:type list (type is float or int) declaring which nginx.log-pattern capture groups are metrics rather than labels."))
+		logPatternFile = GetEnv(
+			"NRE_NGINX_LOG_PATTERN_FILE",
+			*flag.String("nginx.log-pattern-file", "", "YAML file with a \"patterns\" map of named grok patterns (the \"default\" pattern is used to parse log lines) and an optional \"types\" map of name:type overrides, same as nginx.log-pattern-types."))
+		metricsConfig = GetEnv(
+			"NRE_METRICS_CONFIG",
+			*flag.String("metrics.config", "", "YAML file declaring per-metric collector type, bucket overrides and label allowlists."))
+		metricsMaxSeries = GetEnv(
+			"NRE_METRICS_MAX_SERIES",
+			*flag.String("metrics.max-series", "10000", "Maximum number of distinct label-value series kept across all metrics; further series are dropped."))
+		metricsMaxLabelValues = GetEnv(
+			"NRE_METRICS_MAX_LABEL_VALUES",
+			*flag.String("metrics.max-label-values", "1000", "Maximum number of distinct label-value tuples kept per metric; the least recently used tuple is evicted once exceeded."))
+		logLevel = GetEnv(
+			"NRE_LOG_LEVEL",
+			*flag.String("log.level", "info", "Logging level: debug, info, warn or error."))
+		logOutputFormat = GetEnv(
+			"NRE_LOG_FORMAT",
+			*flag.String("log.format", "logfmt", "Logging output format: logfmt or json."))
+		webConfigFile = GetEnv(
+			"NRE_WEB_CONFIG_FILE",
+			*flag.String("web.config-file", "", "YAML file enabling TLS and/or HTTP basic auth on the metrics server, in the tls_server_config/basic_auth_users shape used by other Prometheus exporters."))
 	)
 	flag.Parse()
 	return map[string]string{
-		"listenAddress": listenAddress,
-		"metricsPath":   metricsPath,
-		"syslogAddress": syslogAddress,
-		"metricBuckets": metricBuckets,
+		"listenAddress":         listenAddress,
+		"metricsPath":           metricsPath,
+		"syslogAddress":         syslogAddress,
+		"syslogFormat":          syslogFormat,
+		"syslogTLSCertFile":     syslogTLSCertFile,
+		"syslogTLSKeyFile":      syslogTLSKeyFile,
+		"syslogTLSCAFile":       syslogTLSCAFile,
+		"metricBuckets":         metricBuckets,
+		"logFormat":             logFormat,
+		"logPattern":            logPattern,
+		"logPatternTypes":       logPatternTypes,
+		"logPatternFile":        logPatternFile,
+		"metricsConfig":         metricsConfig,
+		"metricsMaxSeries":      metricsMaxSeries,
+		"metricsMaxLabelValues": metricsMaxLabelValues,
+		"logLevel":              logLevel,
+		"logOutputFormat":       logOutputFormat,
+		"webConfigFile":         webConfigFile,
 	}
 }
 
 // Listen to signals
-func waitForShutdown(server *syslog.Server, err error) {
+func waitForShutdown(ctx context.Context, cancel context.CancelFunc, server *syslog.Server, webServer *http.Server) {
+	log := logger.FromContext(ctx)
+
 	sigchan := make(chan os.Signal, 1)
 	signal.Notify(sigchan, syscall.SIGTERM, syscall.SIGINT)
 
-	s := <-sigchan
-	log.Infof("Received %v, terminating", s)
-	err = server.Kill()
-	if err != nil {
-		log.Error(err)
+	select {
+	case s := <-sigchan:
+		log.Info("received signal, terminating", "signal", s)
+	case <-ctx.Done():
+	}
+	cancel()
+
+	if err := server.Kill(); err != nil {
+		log.Error("stopping syslog server", "error", err)
+	}
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer shutdownCancel()
+	if err := webServer.Shutdown(shutdownCtx); err != nil {
+		log.Error("shutting down web server", "error", err)
 	}
-	os.Exit(0)
 }
@@ -0,0 +1,227 @@
+// Copyright 2020 Volodymyr Polishchuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Metric is a single observed value extracted from an nginx log line,
+// destined for the Prometheus collector of the same Name (a HistogramVec
+// unless --metrics.config declares another type for it).
+type Metric struct {
+	Name  string
+	Value float64
+}
+
+// Labels holds the label names/values pair shared by every Metric parsed
+// out of a single log line. Names and Values are kept as parallel slices
+// because that's the shape prometheus.HistogramVec.WithLabelValues expects.
+type Labels struct {
+	Names  []string
+	Values []string
+}
+
+// Parser turns the content of one nginx log/syslog line into the metrics
+// and labels it describes. Implementations are selected by the
+// --nginx.log-format flag.
+type Parser interface {
+	Parse(content string) ([]Metric, Labels, error)
+}
+
+// newParser builds the Parser selected by the --nginx.log-format flag.
+func newParser(logFormat, logPattern, logPatternTypes, logPatternFile string) (Parser, error) {
+	switch strings.ToLower(logFormat) {
+	case "", "keyvalue":
+		return &KeyValueParser{}, nil
+	case "json":
+		return &JSONParser{}, nil
+	case "grok":
+		patterns, types, err := loadGrokPatterns(logPattern, logPatternTypes, logPatternFile)
+		if err != nil {
+			return nil, err
+		}
+		return newGrokParser(patterns, types)
+	default:
+		return nil, fmt.Errorf("unknown nginx.log-format %q (want keyvalue, json or grok)", logFormat)
+	}
+}
+
+// KeyValueParser parses the original log_format convention of this
+// exporter: a "metrics=" prefixed, comma-separated list of name:value
+// pairs, followed by space-separated label=value pairs, e.g.
+//
+//	metrics=request_time:0.123,bytes_sent:512 host=example.com status=200
+type KeyValueParser struct{}
+
+func (p *KeyValueParser) Parse(content string) ([]Metric, Labels, error) {
+	fields := strings.Fields(content)
+	if len(fields) == 0 {
+		return nil, Labels{}, fmt.Errorf("empty log line")
+	}
+	if !strings.HasPrefix(fields[0], "metrics=") {
+		return nil, Labels{}, fmt.Errorf("log line missing metrics= field: %q", content)
+	}
+
+	metrics, err := parseKeyValueMetrics(strings.TrimPrefix(fields[0], "metrics="))
+	if err != nil {
+		return nil, Labels{}, err
+	}
+
+	labels := Labels{}
+	for _, field := range fields[1:] {
+		name, value, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+		labels.Names = append(labels.Names, name)
+		labels.Values = append(labels.Values, value)
+	}
+	return metrics, labels, nil
+}
+
+func parseKeyValueMetrics(raw string) ([]Metric, error) {
+	var metrics []Metric
+	for _, pair := range strings.Split(raw, ",") {
+		name, value, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed metric %q, want name:value", pair)
+		}
+		floatValue, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("metric %q: %w", name, err)
+		}
+		metrics = append(metrics, Metric{Name: name, Value: floatValue})
+	}
+	return metrics, nil
+}
+
+// JSONParser parses nginx access log lines produced by a
+// `log_format ... escape=json` directive, where every JSON object key
+// either names a metric (numeric value) or a label (everything else).
+type JSONParser struct {
+	// MetricKeys restricts which object keys are treated as metrics; if
+	// empty, any key holding a JSON number is treated as one.
+	MetricKeys map[string]bool
+}
+
+func (p *JSONParser) Parse(content string) ([]Metric, Labels, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(content), &fields); err != nil {
+		return nil, Labels{}, fmt.Errorf("invalid JSON log line: %w", err)
+	}
+
+	var metrics []Metric
+	labels := Labels{}
+	for name, value := range fields {
+		if number, ok := value.(float64); ok && (len(p.MetricKeys) == 0 || p.MetricKeys[name]) {
+			metrics = append(metrics, Metric{Name: name, Value: number})
+			continue
+		}
+		labels.Names = append(labels.Names, name)
+		labels.Values = append(labels.Values, fmt.Sprintf("%v", value))
+	}
+	return metrics, labels, nil
+}
+
+// grokField describes one capture group of a compiled Grok pattern and how
+// to turn its captured text into a Metric or a Label. name is empty for an
+// unnamed capture group, which is kept as a placeholder (rather than
+// dropped) so fields stays aligned with the match slice FindStringSubmatch
+// returns.
+type grokField struct {
+	name string
+	kind string // "float", "int" or "label"
+}
+
+// GrokParser extracts metrics and labels from an arbitrary nginx log line
+// using a regular expression with named capture groups, configured via
+// --nginx.log-pattern or --nginx.log-pattern-file. Go's regexp package
+// restricts capture group names to [A-Za-z0-9_]+, so a group's type can't
+// be encoded in its name; instead, --nginx.log-pattern-types (or the
+// "types" map in --nginx.log-pattern-file) says which named groups are
+// "float" or "int" metrics. Any named group absent from that mapping
+// becomes a label.
+type GrokParser struct {
+	re     *regexp.Regexp
+	fields []grokField
+}
+
+func newGrokParser(patterns []string, types map[string]string) (*GrokParser, error) {
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("grok log format requires --nginx.log-pattern or --nginx.log-pattern-file")
+	}
+	// Only the first pattern is used to parse each line; a file may
+	// define auxiliary named patterns for composition in the future.
+	re, err := regexp.Compile(patterns[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid nginx.log-pattern: %w", err)
+	}
+
+	names := re.SubexpNames()
+	fields := make([]grokField, 0, len(names)-1)
+	for _, name := range names[1:] {
+		if name == "" {
+			fields = append(fields, grokField{})
+			continue
+		}
+		kind := types[name]
+		if kind == "" {
+			kind = "label"
+		}
+		fields = append(fields, grokField{name: name, kind: kind})
+	}
+	return &GrokParser{re: re, fields: fields}, nil
+}
+
+func (p *GrokParser) Parse(content string) ([]Metric, Labels, error) {
+	match := p.re.FindStringSubmatch(content)
+	if match == nil {
+		return nil, Labels{}, fmt.Errorf("log line did not match nginx.log-pattern: %q", content)
+	}
+
+	var metrics []Metric
+	labels := Labels{}
+	// match[0] is the whole match; group i's text is match[i+1], in the
+	// same order re.SubexpNames() (and therefore p.fields) reports it.
+	for i, field := range p.fields {
+		if field.name == "" {
+			continue
+		}
+		value := match[i+1]
+		switch field.kind {
+		case "float":
+			floatValue, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, Labels{}, fmt.Errorf("field %q: %w", field.name, err)
+			}
+			metrics = append(metrics, Metric{Name: field.name, Value: floatValue})
+		case "int":
+			intValue, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, Labels{}, fmt.Errorf("field %q: %w", field.name, err)
+			}
+			metrics = append(metrics, Metric{Name: field.name, Value: float64(intValue)})
+		default:
+			labels.Names = append(labels.Names, field.name)
+			labels.Values = append(labels.Values, value)
+		}
+	}
+	return metrics, labels, nil
+}
@@ -0,0 +1,177 @@
+// Copyright 2020 Volodymyr Polishchuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+func metricValue(t *testing.T, metrics []Metric, name string) float64 {
+	t.Helper()
+	for _, m := range metrics {
+		if m.Name == name {
+			return m.Value
+		}
+	}
+	t.Fatalf("no metric named %q in %v", name, metrics)
+	return 0
+}
+
+func labelValue(t *testing.T, labels Labels, name string) string {
+	t.Helper()
+	for i, n := range labels.Names {
+		if n == name {
+			return labels.Values[i]
+		}
+	}
+	t.Fatalf("no label named %q in %v", name, labels)
+	return ""
+}
+
+func TestKeyValueParser(t *testing.T) {
+	p := &KeyValueParser{}
+
+	metrics, labels, err := p.Parse("metrics=request_time:0.123,bytes_sent:512 host=example.com status=200")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if got := metricValue(t, metrics, "request_time"); got != 0.123 {
+		t.Errorf("request_time = %v, want 0.123", got)
+	}
+	if got := metricValue(t, metrics, "bytes_sent"); got != 512 {
+		t.Errorf("bytes_sent = %v, want 512", got)
+	}
+	if got := labelValue(t, labels, "host"); got != "example.com" {
+		t.Errorf("host = %q, want example.com", got)
+	}
+
+	if _, _, err := p.Parse(""); err == nil {
+		t.Error("Parse(\"\"): expected an error")
+	}
+	if _, _, err := p.Parse("host=example.com"); err == nil {
+		t.Error("Parse without metrics= field: expected an error")
+	}
+	if _, _, err := p.Parse("metrics=bogus"); err == nil {
+		t.Error("Parse with malformed metric: expected an error")
+	}
+	if _, _, err := p.Parse("metrics=request_time:notanumber"); err == nil {
+		t.Error("Parse with non-numeric metric value: expected an error")
+	}
+}
+
+func TestJSONParser(t *testing.T) {
+	p := &JSONParser{}
+
+	metrics, labels, err := p.Parse(`{"request_time": 0.5, "host": "example.com"}`)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if got := metricValue(t, metrics, "request_time"); got != 0.5 {
+		t.Errorf("request_time = %v, want 0.5", got)
+	}
+	if got := labelValue(t, labels, "host"); got != "example.com" {
+		t.Errorf("host = %q, want example.com", got)
+	}
+
+	if _, _, err := p.Parse("not json"); err == nil {
+		t.Error("Parse(\"not json\"): expected an error")
+	}
+}
+
+func TestJSONParserMetricKeys(t *testing.T) {
+	p := &JSONParser{MetricKeys: map[string]bool{"request_time": true}}
+
+	metrics, labels, err := p.Parse(`{"request_time": 0.5, "status": 200}`)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if len(metrics) != 1 {
+		t.Fatalf("metrics = %v, want exactly request_time", metrics)
+	}
+	if got := labelValue(t, labels, "status"); got != "200" {
+		t.Errorf("status label = %q, want 200", got)
+	}
+}
+
+func TestGrokParser(t *testing.T) {
+	p, err := newGrokParser(
+		[]string{`^(?P<status>\d+) (?P<request_time>[\d.]+) (?P<host>\S+)$`},
+		map[string]string{"status": "int", "request_time": "float"},
+	)
+	if err != nil {
+		t.Fatalf("newGrokParser: %v", err)
+	}
+
+	metrics, labels, err := p.Parse("200 0.25 example.com")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if got := metricValue(t, metrics, "status"); got != 200 {
+		t.Errorf("status = %v, want 200", got)
+	}
+	if got := metricValue(t, metrics, "request_time"); got != 0.25 {
+		t.Errorf("request_time = %v, want 0.25", got)
+	}
+	if got := labelValue(t, labels, "host"); got != "example.com" {
+		t.Errorf("host = %q, want example.com", got)
+	}
+
+	if _, _, err := p.Parse("no match here"); err == nil {
+		t.Error("Parse with no match: expected an error")
+	}
+}
+
+// TestGrokParserUnnamedGroup covers a pattern mixing an unnamed capturing
+// group with named ones: the unnamed group must not shift later fields out
+// of alignment with their captured text.
+func TestGrokParserUnnamedGroup(t *testing.T) {
+	p, err := newGrokParser(
+		[]string{`^(foo|bar) (?P<status>\d+)$`},
+		map[string]string{"status": "int"},
+	)
+	if err != nil {
+		t.Fatalf("newGrokParser: %v", err)
+	}
+
+	metrics, _, err := p.Parse("foo 200")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if got := metricValue(t, metrics, "status"); got != 200 {
+		t.Errorf("status = %v, want 200", got)
+	}
+}
+
+func TestGrokParserInvalidPattern(t *testing.T) {
+	if _, err := newGrokParser([]string{"("}, nil); err == nil {
+		t.Error("newGrokParser with invalid regexp: expected an error")
+	}
+	if _, err := newGrokParser(nil, nil); err == nil {
+		t.Error("newGrokParser with no patterns: expected an error")
+	}
+}
+
+func TestNewParser(t *testing.T) {
+	if _, err := newParser("", "", "", ""); err != nil {
+		t.Errorf("newParser(keyvalue default): %v", err)
+	}
+	if _, err := newParser("json", "", "", ""); err != nil {
+		t.Errorf("newParser(json): %v", err)
+	}
+	if _, err := newParser("grok", `(?P<status>\d+)`, "status:int", ""); err != nil {
+		t.Errorf("newParser(grok): %v", err)
+	}
+	if _, err := newParser("bogus", "", "", ""); err == nil {
+		t.Error("newParser(bogus): expected an error")
+	}
+}
@@ -0,0 +1,31 @@
+// Copyright 2020 Volodymyr Polishchuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "sync/atomic"
+
+// readiness tracks whether the exporter has drained at least one message
+// off the syslog server, for the /-/ready endpoint.
+type readiness struct {
+	ready atomic.Bool
+}
+
+func (r *readiness) markReady() {
+	r.ready.Store(true)
+}
+
+func (r *readiness) isReady() bool {
+	return r.ready.Load()
+}
@@ -0,0 +1,68 @@
+// Copyright 2020 Volodymyr Polishchuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// structuredDataElementRE matches one "[SD-ID param="value" ...]" element
+// of an RFC5424 STRUCTURED-DATA field.
+var structuredDataElementRE = regexp.MustCompile(`\[([^\]]+)\]`)
+
+// structuredDataParamRE matches one param="value" pair within an element.
+var structuredDataParamRE = regexp.MustCompile(`(\S+)="((?:[^"\\]|\\.)*)"`)
+
+// invalidLabelCharRE matches characters a Prometheus label name can't
+// contain; see https://prometheus.io/docs/concepts/data_model/#metric-names-and-labels.
+var invalidLabelCharRE = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// parseStructuredData turns an RFC5424 STRUCTURED-DATA field ("-" when
+// absent) into extra labels, one per SD parameter, named "<SD-ID>_<param>"
+// to keep parameters from different elements apart. go-syslog's RFC5424
+// parser exposes the field verbatim as part["structured_data"]; it is not
+// otherwise parsed by this exporter.
+func parseStructuredData(raw string) Labels {
+	var labels Labels
+	if raw == "" || raw == "-" {
+		return labels
+	}
+
+	for _, element := range structuredDataElementRE.FindAllStringSubmatch(raw, -1) {
+		body := element[1]
+		fields := strings.Fields(body)
+		if len(fields) == 0 {
+			continue
+		}
+		sdID := fields[0]
+		for _, param := range structuredDataParamRE.FindAllStringSubmatch(body, -1) {
+			labels.Names = append(labels.Names, sanitizeLabelName(sdID+"_"+param[1]))
+			labels.Values = append(labels.Values, param[2])
+		}
+	}
+	return labels
+}
+
+// sanitizeLabelName replaces characters Prometheus label names don't
+// allow (an SD-ID commonly contains "@", e.g. "exampleSDID@32473") with
+// underscores, and ensures the result doesn't start with a digit.
+func sanitizeLabelName(name string) string {
+	name = invalidLabelCharRE.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
@@ -0,0 +1,80 @@
+// Copyright 2020 Volodymyr Polishchuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+func TestParseStructuredDataAbsent(t *testing.T) {
+	for _, raw := range []string{"", "-"} {
+		labels := parseStructuredData(raw)
+		if len(labels.Names) != 0 {
+			t.Errorf("parseStructuredData(%q) = %v, want no labels", raw, labels)
+		}
+	}
+}
+
+func TestParseStructuredDataSingleElement(t *testing.T) {
+	labels := parseStructuredData(`[exampleSDID@32473 iut="3" eventSource="Application" eventID="1011"]`)
+
+	want := map[string]string{
+		"exampleSDID_32473_iut":         "3",
+		"exampleSDID_32473_eventSource": "Application",
+		"exampleSDID_32473_eventID":     "1011",
+	}
+	if len(labels.Names) != len(want) {
+		t.Fatalf("labels = %v, want %d entries", labels, len(want))
+	}
+	for i, name := range labels.Names {
+		wantValue, ok := want[name]
+		if !ok {
+			t.Errorf("unexpected label name %q", name)
+			continue
+		}
+		if labels.Values[i] != wantValue {
+			t.Errorf("label %q = %q, want %q", name, labels.Values[i], wantValue)
+		}
+	}
+}
+
+func TestParseStructuredDataMultipleElements(t *testing.T) {
+	labels := parseStructuredData(`[exampleSDID@32473 iut="3"][examplePriority@32473 class="high"]`)
+	if len(labels.Names) != 2 {
+		t.Fatalf("labels = %v, want 2 entries", labels)
+	}
+
+	values := make(map[string]string)
+	for i, name := range labels.Names {
+		values[name] = labels.Values[i]
+	}
+	if values["exampleSDID_32473_iut"] != "3" {
+		t.Errorf("iut = %q, want 3", values["exampleSDID_32473_iut"])
+	}
+	if values["examplePriority_32473_class"] != "high" {
+		t.Errorf("class = %q, want high", values["examplePriority_32473_class"])
+	}
+}
+
+func TestSanitizeLabelName(t *testing.T) {
+	cases := map[string]string{
+		"exampleSDID@32473_iut": "exampleSDID_32473_iut",
+		"123abc":                "_123abc",
+		"already_valid":         "already_valid",
+	}
+	for input, want := range cases {
+		if got := sanitizeLabelName(input); got != want {
+			t.Errorf("sanitizeLabelName(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
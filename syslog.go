@@ -0,0 +1,174 @@
+// Copyright 2020 Volodymyr Polishchuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/volodymyr-polishchuk/nginx-request-exporter/internal/logger"
+	"gopkg.in/mcuadros/go-syslog.v2"
+	syslogformat "gopkg.in/mcuadros/go-syslog.v2/format"
+)
+
+// syslogFormatFromString maps the --nginx.syslog-format flag value to the
+// corresponding go-syslog format implementation.
+func syslogFormatFromString(name string) (syslogformat.Format, error) {
+	switch strings.ToLower(name) {
+	case "rfc3164":
+		return syslog.RFC3164, nil
+	case "rfc5424":
+		return syslog.RFC5424, nil
+	case "rfc6587":
+		return syslog.RFC6587, nil
+	case "auto":
+		return syslog.Automatic, nil
+	default:
+		return nil, fmt.Errorf("unknown nginx.syslog-format %q (want rfc3164, rfc5424, rfc6587 or auto)", name)
+	}
+}
+
+// syslogTLSConfig builds a server-side tls.Config from the configured
+// certificate, key and (optional) client CA files.
+func syslogTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("nginx.syslog-tls-cert-file and nginx.syslog-tls-key-file are required for tcp+tls:// listeners")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if caFile != "" {
+		caCert, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("could not parse %s as a PEM certificate bundle", caFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// Set up syslog server
+func setupSyslogServer(ctx context.Context, syslogAddress, syslogFormat, tlsCertFile, tlsKeyFile, tlsCAFile string) (syslog.LogPartsChannel, *syslog.Server, error) {
+	log := logger.FromContext(ctx)
+
+	format, err := syslogFormatFromString(syslogFormat)
+	if err != nil {
+		logger.Fatal(log, "invalid nginx.syslog-format", "error", err)
+	}
+
+	channel := make(syslog.LogPartsChannel, 20000)
+	handler := syslog.NewChannelHandler(channel)
+	server := syslog.NewServer()
+	server.SetFormat(format)
+	server.SetHandler(handler)
+
+	switch {
+	case strings.HasPrefix(syslogAddress, "tcp+tls://"):
+		tlsConfig, tlsErr := syslogTLSConfig(tlsCertFile, tlsKeyFile, tlsCAFile)
+		if tlsErr != nil {
+			logger.Fatal(log, "invalid syslog TLS configuration", "error", tlsErr)
+		}
+		err = server.ListenTCPTLS(strings.TrimPrefix(syslogAddress, "tcp+tls://"), tlsConfig)
+	case strings.HasPrefix(syslogAddress, "tcp://"):
+		err = server.ListenTCP(strings.TrimPrefix(syslogAddress, "tcp://"))
+	case strings.HasPrefix(syslogAddress, "unixstream://"):
+		err = listenUnixStream(ctx, channel, format, strings.TrimPrefix(syslogAddress, "unixstream://"))
+	case strings.HasPrefix(syslogAddress, "unix:"):
+		err = server.ListenUnixgram(strings.TrimPrefix(syslogAddress, "unix:"))
+	default:
+		err = server.ListenUDP(syslogAddress)
+	}
+	if err != nil {
+		logger.Fatal(log, "starting syslog listener", "address", syslogAddress, "error", err)
+	}
+	err = server.Boot()
+	if err != nil {
+		logger.Fatal(log, "booting syslog server", "error", err)
+	}
+	return channel, server, err
+}
+
+// listenUnixStream accepts connections on a Unix stream socket and feeds
+// the frames read from it into channel, using format's own split function
+// (RFC6587 octet counting for rfc6587; newline-delimited when the format
+// has none, as for rfc3164 and rfc5424) and parser, so behaviour matches
+// the TCP listener exactly.
+// go-syslog v2 only ships a Unix listener for datagram sockets
+// (ListenUnixgram), so stream framing for unixstream:// is handled here.
+// The listener is closed when ctx is cancelled so shutdown doesn't leave it
+// accepting connections after the rest of the exporter has stopped.
+func listenUnixStream(ctx context.Context, channel syslog.LogPartsChannel, format syslogformat.Format, addr string) error {
+	log := logger.FromContext(ctx)
+
+	_ = os.Remove(addr)
+	listener, err := net.Listen("unix", addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Error("accepting unix stream connection", "error", err)
+				}
+				return
+			}
+			go serveUnixStreamConn(ctx, conn, channel, format)
+		}
+	}()
+	return nil
+}
+
+func serveUnixStreamConn(ctx context.Context, conn net.Conn, channel syslog.LogPartsChannel, format syslogformat.Format) {
+	log := logger.FromContext(ctx)
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	if sf := format.GetSplitFunc(); sf != nil {
+		scanner.Split(sf)
+	}
+	for scanner.Scan() {
+		parser := format.GetParser(scanner.Bytes())
+		if err := parser.Parse(); err != nil {
+			log.Error("parsing unix stream frame", "error", err)
+			continue
+		}
+		channel <- parser.Dump()
+	}
+	if err := scanner.Err(); err != nil {
+		log.Error("reading unix stream connection", "error", err)
+	}
+}
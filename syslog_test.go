@@ -0,0 +1,91 @@
+// Copyright 2020 Volodymyr Polishchuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/mcuadros/go-syslog.v2"
+)
+
+func TestSyslogFormatFromString(t *testing.T) {
+	for _, name := range []string{"rfc3164", "rfc5424", "rfc6587", "auto"} {
+		if _, err := syslogFormatFromString(name); err != nil {
+			t.Errorf("syslogFormatFromString(%q): %v", name, err)
+		}
+	}
+	if _, err := syslogFormatFromString("bogus"); err == nil {
+		t.Error("syslogFormatFromString(\"bogus\"): expected an error")
+	}
+}
+
+// TestListenUnixStreamFormats dials a unixstream:// listener for every
+// format nginx.syslog-format accepts and checks that a single connection
+// delivers a message instead of crashing the accept goroutine. This guards
+// against formats whose GetSplitFunc() returns nil (rfc3164, rfc5424),
+// which previously panicked serveUnixStreamConn.
+func TestListenUnixStreamFormats(t *testing.T) {
+	cases := []struct {
+		name    string
+		format  string
+		framing string
+	}{
+		{"rfc3164", "rfc3164", "<14>Jan  1 00:00:00 host nginx: hello\n"},
+		{"rfc5424", "rfc5424", "<14>1 2020-01-01T00:00:00Z host nginx 1 - - hello\n"},
+		{"auto", "auto", "<14>Jan  1 00:00:00 host nginx: hello\n"},
+		{"rfc6587", "rfc6587", "49 <14>1 2020-01-01T00:00:00Z host nginx 1 - - hello"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			format, err := syslogFormatFromString(c.format)
+			if err != nil {
+				t.Fatalf("syslogFormatFromString: %v", err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			channel := make(syslog.LogPartsChannel, 1)
+			addr := filepath.Join(t.TempDir(), "syslog.sock")
+			if err := listenUnixStream(ctx, channel, format, addr); err != nil {
+				t.Fatalf("listenUnixStream: %v", err)
+			}
+
+			conn, err := net.Dial("unix", addr)
+			if err != nil {
+				t.Fatalf("dialing %s: %v", addr, err)
+			}
+			if _, err := fmt.Fprint(conn, c.framing); err != nil {
+				t.Fatalf("writing frame: %v", err)
+			}
+			conn.Close()
+
+			select {
+			case parts := <-channel:
+				if len(parts) == 0 {
+					t.Error("expected a non-empty LogParts")
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("timed out waiting for a message on the channel")
+			}
+		})
+	}
+}
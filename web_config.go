@@ -0,0 +1,124 @@
+// Copyright 2020 Volodymyr Polishchuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// TLSServerConfig configures the metrics server's TLS listener, in the
+// same shape other Prometheus exporters accept via --web.config-file.
+type TLSServerConfig struct {
+	CertFile       string `yaml:"cert_file"`
+	KeyFile        string `yaml:"key_file"`
+	ClientCAFile   string `yaml:"client_ca_file"`
+	ClientAuthType string `yaml:"client_auth_type"`
+}
+
+// WebConfig is the root of the --web.config-file YAML file.
+type WebConfig struct {
+	TLSServerConfig *TLSServerConfig  `yaml:"tls_server_config"`
+	BasicAuthUsers  map[string]string `yaml:"basic_auth_users"`
+}
+
+// loadWebConfig reads and parses --web.config-file. An empty path yields
+// an empty WebConfig, under which the metrics server serves plain HTTP
+// with no authentication.
+func loadWebConfig(path string) (*WebConfig, error) {
+	if path == "" {
+		return &WebConfig{}, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading web.config-file: %w", err)
+	}
+
+	var config WebConfig
+	if err := yaml.Unmarshal(raw, &config); err != nil {
+		return nil, fmt.Errorf("parsing web.config-file: %w", err)
+	}
+	return &config, nil
+}
+
+// tlsConfig builds the *tls.Config for the metrics server from the
+// web.config-file's tls_server_config. It does not load CertFile/KeyFile
+// itself: callers pass those straight to http.Server.ListenAndServeTLS, which
+// fills in the Certificates this tls.Config leaves empty.
+func (c *TLSServerConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if c.ClientCAFile != "" {
+		caCert, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("could not parse %s as a PEM certificate bundle", c.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+	}
+
+	authType, err := clientAuthTypeFromString(c.ClientAuthType)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ClientAuth = authType
+	return tlsConfig, nil
+}
+
+func clientAuthTypeFromString(name string) (tls.ClientAuthType, error) {
+	switch name {
+	case "", "NoClientCert":
+		return tls.NoClientCert, nil
+	case "RequestClientCert":
+		return tls.RequestClientCert, nil
+	case "RequireAnyClientCert":
+		return tls.RequireAnyClientCert, nil
+	case "VerifyClientCertIfGiven":
+		return tls.VerifyClientCertIfGiven, nil
+	case "RequireAndVerifyClientCert":
+		return tls.RequireAndVerifyClientCert, nil
+	default:
+		return 0, fmt.Errorf("unknown client_auth_type %q", name)
+	}
+}
+
+// basicAuthMiddleware rejects requests that don't present one of users'
+// credentials with 401 Unauthorized. Passwords are compared as bcrypt
+// hashes, matching the web.config-file convention of other exporters.
+func basicAuthMiddleware(users map[string]string, next http.Handler) http.Handler {
+	if len(users) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		hash, known := users[username]
+		if !ok || !known || bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+applicationName+`"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
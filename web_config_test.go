@@ -0,0 +1,250 @@
+// Copyright 2020 Volodymyr Polishchuk
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func bcryptHash(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("bcrypt.GenerateFromPassword: %v", err)
+	}
+	return string(hash)
+}
+
+func TestBasicAuthMiddlewareAcceptsCorrectCredentials(t *testing.T) {
+	users := map[string]string{"alice": bcryptHash(t, "hunter2")}
+	ok := false
+	handler := basicAuthMiddleware(users, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok = true
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.SetBasicAuth("alice", "hunter2")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want 200", rec.Code)
+	}
+	if !ok {
+		t.Error("next handler was not invoked")
+	}
+}
+
+func TestBasicAuthMiddlewareRejectsWrongPassword(t *testing.T) {
+	users := map[string]string{"alice": bcryptHash(t, "hunter2")}
+	handler := basicAuthMiddleware(users, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("next handler should not be invoked")
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.SetBasicAuth("alice", "wrongpassword")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", rec.Code)
+	}
+}
+
+func TestBasicAuthMiddlewareRejectsUnknownUser(t *testing.T) {
+	users := map[string]string{"alice": bcryptHash(t, "hunter2")}
+	handler := basicAuthMiddleware(users, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("next handler should not be invoked")
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.SetBasicAuth("bob", "hunter2")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", rec.Code)
+	}
+}
+
+func TestBasicAuthMiddlewareRejectsMissingCredentials(t *testing.T) {
+	users := map[string]string{"alice": bcryptHash(t, "hunter2")}
+	handler := basicAuthMiddleware(users, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("next handler should not be invoked")
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", rec.Code)
+	}
+}
+
+func TestBasicAuthMiddlewareNoUsersConfigured(t *testing.T) {
+	ok := false
+	handler := basicAuthMiddleware(nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok = true
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want 200", rec.Code)
+	}
+	if !ok {
+		t.Error("next handler was not invoked when no users are configured")
+	}
+}
+
+func TestClientAuthTypeFromString(t *testing.T) {
+	cases := map[string]tls.ClientAuthType{
+		"":                           tls.NoClientCert,
+		"NoClientCert":               tls.NoClientCert,
+		"RequestClientCert":          tls.RequestClientCert,
+		"RequireAnyClientCert":       tls.RequireAnyClientCert,
+		"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+		"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+	}
+	for name, want := range cases {
+		got, err := clientAuthTypeFromString(name)
+		if err != nil {
+			t.Errorf("clientAuthTypeFromString(%q): %v", name, err)
+		}
+		if got != want {
+			t.Errorf("clientAuthTypeFromString(%q) = %v, want %v", name, got, want)
+		}
+	}
+
+	if _, err := clientAuthTypeFromString("bogus"); err == nil {
+		t.Error("clientAuthTypeFromString(\"bogus\"): expected an error")
+	}
+}
+
+// selfSignedCAPEM generates a throwaway self-signed certificate and returns
+// it PEM-encoded, for use as a tls_server_config client_ca_file fixture.
+func selfSignedCAPEM(t *testing.T) []byte {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test-ca"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, pub, priv)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestTLSServerConfigTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	caPath := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caPath, selfSignedCAPEM(t), 0o600); err != nil {
+		t.Fatalf("writing CA fixture: %v", err)
+	}
+
+	c := &TLSServerConfig{ClientCAFile: caPath, ClientAuthType: "RequireAndVerifyClientCert"}
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		t.Fatalf("tlsConfig: %v", err)
+	}
+	if tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("ClientAuth = %v, want RequireAndVerifyClientCert", tlsConfig.ClientAuth)
+	}
+	if tlsConfig.ClientCAs == nil {
+		t.Error("ClientCAs was not populated from client_ca_file")
+	}
+}
+
+func TestTLSServerConfigTLSConfigInvalidCA(t *testing.T) {
+	dir := t.TempDir()
+	caPath := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caPath, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatalf("writing CA fixture: %v", err)
+	}
+
+	c := &TLSServerConfig{ClientCAFile: caPath}
+	if _, err := c.tlsConfig(); err == nil {
+		t.Error("tlsConfig with invalid CA PEM: expected an error")
+	}
+}
+
+func TestTLSServerConfigTLSConfigInvalidAuthType(t *testing.T) {
+	c := &TLSServerConfig{ClientAuthType: "bogus"}
+	if _, err := c.tlsConfig(); err == nil {
+		t.Error("tlsConfig with invalid client_auth_type: expected an error")
+	}
+}
+
+func TestLoadWebConfigEmptyPath(t *testing.T) {
+	config, err := loadWebConfig("")
+	if err != nil {
+		t.Fatalf("loadWebConfig: %v", err)
+	}
+	if config.TLSServerConfig != nil || len(config.BasicAuthUsers) != 0 {
+		t.Errorf("config = %+v, want zero value", config)
+	}
+}
+
+func TestLoadWebConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "web.yaml")
+	content := "basic_auth_users:\n  alice: \"$2y$10$abcdefghijklmnopqrstuv\"\ntls_server_config:\n  cert_file: cert.pem\n  key_file: key.pem\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("writing fixture: %v", err)
+	}
+
+	config, err := loadWebConfig(path)
+	if err != nil {
+		t.Fatalf("loadWebConfig: %v", err)
+	}
+	if config.TLSServerConfig == nil || config.TLSServerConfig.CertFile != "cert.pem" {
+		t.Errorf("TLSServerConfig = %+v", config.TLSServerConfig)
+	}
+	if config.BasicAuthUsers["alice"] == "" {
+		t.Errorf("BasicAuthUsers = %v", config.BasicAuthUsers)
+	}
+}
+
+func TestLoadWebConfigMissingFile(t *testing.T) {
+	if _, err := loadWebConfig("/nonexistent/web.yaml"); err == nil {
+		t.Error("loadWebConfig with missing file: expected an error")
+	}
+}